@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/fuse"
@@ -26,7 +27,45 @@ import (
 	"github.com/jacobsa/gcsfuse/timeutil"
 )
 
-// Common attributes for files and directories.
+// Flags accepted by SetXattr, mirroring the XATTR_CREATE/XATTR_REPLACE
+// flags taken by setxattr(2).
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// Limits enforced on the xattr store of a single inode, chosen to match
+// the XATTR_SIZE_MAX and XATTR_LIST_MAX limits of Linux.
+const (
+	xattrNameMax      = 255
+	xattrValueSizeMax = 65536
+	xattrTotalSizeMax = 65536
+)
+
+// whence values accepted by inode.Lseek, matching the SEEK_DATA/SEEK_HOLE
+// extensions to lseek(2) on Linux.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// The type of node an inode represents. Every inode is exactly one of these;
+// unlike the old dir bool, this has room to grow as memfs learns to model
+// more of the file system.
+type inodeType int
+
+const (
+	// A regular file, with sparse contents.
+	inodeTypeFile inodeType = iota
+
+	// A directory, with a table of entries.
+	inodeTypeDir
+
+	// A symbolic link, with a target path.
+	inodeTypeSymlink
+)
+
+// Common attributes for files, directories, and symlinks.
 type inode struct {
 	/////////////////////////
 	// Dependencies
@@ -38,8 +77,8 @@ type inode struct {
 	// Constant data
 	/////////////////////////
 
-	// Is this a directory? If not, it is a file.
-	dir bool
+	// What kind of node is this?
+	kind inodeType
 
 	/////////////////////////
 	// Mutable state
@@ -56,38 +95,75 @@ type inode struct {
 
 	// The current attributes of this inode.
 	//
-	// INVARIANT: No non-permission mode bits are set besides os.ModeDir
-	// INVARIANT: If dir, then os.ModeDir is set
-	// INVARIANT: If !dir, then os.ModeDir is not set
-	// INVARIANT: attributes.Size == len(contents)
+	// INVARIANT: No non-permission mode bits are set besides os.ModeDir and
+	// os.ModeSymlink
+	// INVARIANT: If kind == inodeTypeDir, then os.ModeDir is set
+	// INVARIANT: If kind == inodeTypeSymlink, then os.ModeSymlink is set
+	// INVARIANT: If kind == inodeTypeFile, then neither bit is set
+	// INVARIANT: attributes.Size > contents.maxOffset(), if kind == inodeTypeFile
 	attributes fuse.InodeAttributes // GUARDED_BY(mu)
 
-	// For directories, entries describing the children of the directory. Unused
-	// entries are of type DT_Unknown.
+	// For directories, a table describing the children of the directory.
+	// Wrapped in a pointer so that it can be shared, copy-on-write, with a
+	// snapshot taken by Snapshot.
+	//
+	// INVARIANT: If kind != inodeTypeDir, this is nil.
+	// INVARIANT: If kind == inodeTypeDir, this is non-nil.
+	entries *entryTable // GUARDED_BY(mu)
+
+	// For files, the current contents of the file, represented sparsely so
+	// that holes (regions never written, e.g. past a truncate-up or a write
+	// beyond EOF) don't cost any memory.
 	//
-	// This array can never be shortened, nor can its elements be moved, because
-	// we use its indices for Dirent.Offset, which is exposed to the user who
-	// might be calling readdir in a loop while concurrently modifying the
-	// directory. Unused entries can, however, be reused.
+	// INVARIANT: If kind != inodeTypeFile, this is nil.
+	contents *sparseFile // GUARDED_BY(mu)
+
+	// For symlinks, the path that the link points at.
 	//
-	// INVARIANT: If dir is false, this is nil.
-	// INVARIANT: For each i, entries[i].Offset == i+1
-	// INVARIANT: Contains no duplicate names in used entries.
-	entries []fuseutil.Dirent // GUARDED_BY(mu)
+	// INVARIANT: If kind == inodeTypeSymlink, this is non-empty.
+	// INVARIANT: If kind != inodeTypeSymlink, this is empty.
+	target string // GUARDED_BY(mu)
 
-	// For files, the current contents of the file.
+	// Extended attributes set on this inode, keyed by name.
 	//
-	// INVARIANT: If dir is true, this is nil.
-	contents []byte // GUARDED_BY(mu)
+	// INVARIANT: No key is the empty string.
+	// INVARIANT: len(key) <= xattrNameMax for every key.
+	// INVARIANT: len(value) <= xattrValueSizeMax for every value.
+	// INVARIANT: The sum of len(value) over all values is <= xattrTotalSizeMax.
+	xattrs map[string][]byte // GUARDED_BY(mu)
 }
 
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
-// Create a new inode with the supplied attributes, which need not contain
-// time-related information (the inode object will take care of that).
-// Initially the link count is one.
+// The children of a directory inode, wrapped so that a snapshot can hold a
+// reference to one generation of the table while the live inode moves on to
+// another.
+//
+// This array can never be shortened, nor can its elements be moved, because
+// we use its indices for Dirent.Offset, which is exposed to the user who
+// might be calling readdir in a loop while concurrently modifying the
+// directory. Unused entries can, however, be reused.
+//
+// INVARIANT: For each i, entries[i].Offset == i+1
+// INVARIANT: Contains no duplicate names in used entries.
+type entryTable struct {
+	entries []fuseutil.Dirent
+
+	// The number of outstanding snapshots that hold a reference to this
+	// generation of the table. While this is positive, the owning inode must
+	// copy the table before mutating it rather than updating it in place.
+	refCount int
+}
+
+func newEntryTable() *entryTable {
+	return &entryTable{}
+}
+
+// Create a new file or directory inode with the supplied attributes, which
+// need not contain time-related information (the inode object will take
+// care of that). Initially the link count is one.
 func newInode(
 	clock timeutil.Clock,
 	attrs fuse.InodeAttributes) (in *inode) {
@@ -96,14 +172,55 @@ func newInode(
 	attrs.Mtime = now
 	attrs.Crtime = now
 
+	// Figure out the kind from the mode bits.
+	kind := inodeTypeFile
+	if attrs.Mode&os.ModeDir != 0 {
+		kind = inodeTypeDir
+	}
+
 	// Create the object.
 	in = &inode{
 		clock:      clock,
 		linkCount:  1,
-		dir:        (attrs.Mode&os.ModeDir != 0),
+		kind:       kind,
 		attributes: attrs,
 	}
 
+	switch kind {
+	case inodeTypeFile:
+		in.contents = newSparseFile()
+	case inodeTypeDir:
+		in.entries = newEntryTable()
+	}
+
+	in.mu = syncutil.NewInvariantMutex(in.checkInvariants)
+	return
+}
+
+// Create a new symlink inode whose target is the supplied path. Initially
+// the link count is one.
+func newSymlinkInode(
+	clock timeutil.Clock,
+	attrs fuse.InodeAttributes,
+	target string) (in *inode) {
+	// Update time info.
+	now := clock.Now()
+	attrs.Mtime = now
+	attrs.Crtime = now
+
+	// Symlinks are reported with the permission bits of a regular file, plus
+	// the symlink bit.
+	attrs.Mode = attrs.Mode&os.ModePerm | os.ModeSymlink
+
+	// Create the object.
+	in = &inode{
+		clock:      clock,
+		linkCount:  1,
+		kind:       inodeTypeSymlink,
+		attributes: attrs,
+		target:     target,
+	}
+
 	in.mu = syncutil.NewInvariantMutex(in.checkInvariants)
 	return
 }
@@ -114,28 +231,46 @@ func (inode *inode) checkInvariants() {
 		panic(fmt.Sprintf("Negative link count: %v", inode.linkCount))
 	}
 
-	// No non-permission mode bits should be set besides os.ModeDir.
-	if inode.attributes.Mode & ^(os.ModePerm|os.ModeDir) != 0 {
+	// No non-permission mode bits should be set besides os.ModeDir and
+	// os.ModeSymlink.
+	if inode.attributes.Mode & ^(os.ModePerm|os.ModeDir|os.ModeSymlink) != 0 {
 		panic(fmt.Sprintf("Unexpected mode: %v", inode.attributes.Mode))
 	}
 
-	// Check os.ModeDir.
-	if inode.dir != (inode.attributes.Mode&os.ModeDir == os.ModeDir) {
-		panic(
-			fmt.Sprintf(
-				"Unexpected mode: %v, dir: %v",
-				inode.attributes.Mode,
-				inode.dir))
+	// Check the mode bits against the kind.
+	switch inode.kind {
+	case inodeTypeDir:
+		if inode.attributes.Mode&os.ModeDir == 0 {
+			panic(fmt.Sprintf("Unexpected mode for dir: %v", inode.attributes.Mode))
+		}
+	case inodeTypeSymlink:
+		if inode.attributes.Mode&os.ModeSymlink == 0 {
+			panic(fmt.Sprintf("Unexpected mode for symlink: %v", inode.attributes.Mode))
+		}
+	case inodeTypeFile:
+		if inode.attributes.Mode&(os.ModeDir|os.ModeSymlink) != 0 {
+			panic(fmt.Sprintf("Unexpected mode for file: %v", inode.attributes.Mode))
+		}
+	default:
+		panic(fmt.Sprintf("Unknown kind: %v", inode.kind))
 	}
 
 	// Check directory-specific stuff.
-	if inode.dir {
+	if inode.kind == inodeTypeDir {
 		if inode.contents != nil {
 			panic("Non-nil contents in a directory.")
 		}
 
+		if inode.target != "" {
+			panic("Non-empty target in a directory.")
+		}
+
+		if inode.entries == nil {
+			panic("Nil entries in a directory.")
+		}
+
 		childNames := make(map[string]struct{})
-		for i, e := range inode.entries {
+		for i, e := range inode.entries.entries {
 			if e.Offset != fuse.DirOffset(i+1) {
 				panic(fmt.Sprintf("Unexpected offset: %v", e.Offset))
 			}
@@ -148,36 +283,80 @@ func (inode *inode) checkInvariants() {
 				childNames[e.Name] = struct{}{}
 			}
 		}
+	} else {
+		if inode.entries != nil {
+			panic("Non-nil entries in a non-directory.")
+		}
 	}
 
 	// Check file-specific stuff.
-	if !inode.dir {
-		if inode.entries != nil {
-			panic("Non-nil entries in a file.")
+	if inode.kind == inodeTypeFile {
+		if inode.target != "" {
+			panic("Non-empty target in a file.")
+		}
+	} else if inode.kind != inodeTypeDir {
+		if inode.contents != nil {
+			panic("Non-nil contents in a non-file.")
+		}
+	}
+
+	// Check symlink-specific stuff.
+	if inode.kind == inodeTypeSymlink {
+		if inode.target == "" {
+			panic("Empty target in a symlink.")
+		}
+	}
+
+	// Check the size. The logical size may exceed the highest offset
+	// actually backed by storage, since writing or truncating past EOF
+	// leaves a hole rather than allocating zeroed pages. A page present at
+	// idx only guarantees a byte somewhere in [idx*pageSize, (idx+1)*pageSize),
+	// so Size must be strictly greater than the start of the highest such page.
+	if inode.kind == inodeTypeFile {
+		if maxPageStart := inode.contents.maxOffset(); maxPageStart >= 0 &&
+			inode.attributes.Size <= uint64(maxPageStart) {
+			panic(
+				fmt.Sprintf(
+					"Size too small for max written page: %v vs. %v",
+					inode.attributes.Size,
+					maxPageStart))
+		}
+	}
+
+	// Check the xattr store.
+	var totalXattrSize int
+	for name, value := range inode.xattrs {
+		if name == "" {
+			panic("Empty xattr name.")
+		}
+
+		if len(name) > xattrNameMax {
+			panic(fmt.Sprintf("Xattr name too long: %s", name))
 		}
+
+		if len(value) > xattrValueSizeMax {
+			panic(fmt.Sprintf("Xattr value too large for %s: %v bytes", name, len(value)))
+		}
+
+		totalXattrSize += len(value)
 	}
 
-	// Check the size.
-	if inode.attributes.Size != uint64(len(inode.contents)) {
-		panic(
-			fmt.Sprintf(
-				"Unexpected size: %v vs. %v",
-				inode.attributes.Size,
-				len(inode.contents)))
+	if totalXattrSize > xattrTotalSizeMax {
+		panic(fmt.Sprintf("Total xattr size too large: %v bytes", totalXattrSize))
 	}
 }
 
 // Return the index of the child within inode.entries, if it exists.
 //
-// REQUIRES: inode.dir
+// REQUIRES: inode.kind == inodeTypeDir
 // SHARED_LOCKS_REQUIRED(inode.mu)
 func (inode *inode) findChild(name string) (i int, ok bool) {
-	if !inode.dir {
+	if inode.kind != inodeTypeDir {
 		panic("findChild called on non-directory.")
 	}
 
 	var e fuseutil.Dirent
-	for i, e = range inode.entries {
+	for i, e = range inode.entries.entries {
 		if e.Name == name {
 			ok = true
 			return
@@ -187,16 +366,32 @@ func (inode *inode) findChild(name string) (i int, ok bool) {
 	return
 }
 
+// If another snapshot holds a reference to the current generation of the
+// entry table, copy it so that the upcoming mutation doesn't disturb the
+// snapshot's view.
+//
+// REQUIRES: inode.kind == inodeTypeDir
+// EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) cowEntries() {
+	if inode.entries.refCount == 0 {
+		return
+	}
+
+	inode.entries = &entryTable{
+		entries: append([]fuseutil.Dirent(nil), inode.entries.entries...),
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Public methods
 ////////////////////////////////////////////////////////////////////////
 
 // Return the number of children of the directory.
 //
-// REQUIRES: inode.dir
+// REQUIRES: inode.kind == inodeTypeDir
 // SHARED_LOCKS_REQUIRED(inode.mu)
 func (inode *inode) Len() (n int) {
-	for _, e := range inode.entries {
+	for _, e := range inode.entries.entries {
 		if e.Type != fuseutil.DT_Unknown {
 			n++
 		}
@@ -207,20 +402,23 @@ func (inode *inode) Len() (n int) {
 
 // Find an entry for the given child name and return its inode ID.
 //
-// REQUIRES: inode.dir
+// REQUIRES: inode.kind == inodeTypeDir
 // SHARED_LOCKS_REQUIRED(inode.mu)
 func (inode *inode) LookUpChild(name string) (id fuse.InodeID, ok bool) {
 	index, ok := inode.findChild(name)
 	if ok {
-		id = inode.entries[index].Inode
+		id = inode.entries.entries[index].Inode
 	}
 
 	return
 }
 
-// Add an entry for a child.
+// Add an entry for a child. Used both for regular directory entries and for
+// hardlinks, where id refers to an inode that already has other entries
+// pointing at it; the caller is responsible for calling IncrementLinkCount
+// in the latter case.
 //
-// REQUIRES: inode.dir
+// REQUIRES: inode.kind == inodeTypeDir
 // REQUIRES: dt != fuseutil.DT_Unknown
 // EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
 func (inode *inode) AddChild(
@@ -229,13 +427,15 @@ func (inode *inode) AddChild(
 	dt fuseutil.DirentType) {
 	var index int
 
+	inode.cowEntries()
+
 	// Update the modification time.
 	inode.attributes.Mtime = inode.clock.Now()
 
 	// No matter where we place the entry, make sure it has the correct Offset
 	// field.
 	defer func() {
-		inode.entries[index].Offset = fuse.DirOffset(index + 1)
+		inode.entries.entries[index].Offset = fuse.DirOffset(index + 1)
 	}()
 
 	// Set up the entry.
@@ -246,35 +446,38 @@ func (inode *inode) AddChild(
 	}
 
 	// Look for a gap in which we can insert it.
-	for index = range inode.entries {
-		if inode.entries[index].Type == fuseutil.DT_Unknown {
-			inode.entries[index] = e
+	for index = range inode.entries.entries {
+		if inode.entries.entries[index].Type == fuseutil.DT_Unknown {
+			inode.entries.entries[index] = e
 			return
 		}
 	}
 
 	// Append it to the end.
-	index = len(inode.entries)
-	inode.entries = append(inode.entries, e)
+	index = len(inode.entries.entries)
+	inode.entries.entries = append(inode.entries.entries, e)
 }
 
 // Remove an entry for a child.
 //
-// REQUIRES: inode.dir
+// REQUIRES: inode.kind == inodeTypeDir
 // REQUIRES: An entry for the given name exists.
 // EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
 func (inode *inode) RemoveChild(name string) {
-	// Update the modification time.
-	inode.attributes.Mtime = inode.clock.Now()
-
-	// Find the entry.
+	// Find the entry before copying on write, so the panic below on a
+	// missing name doesn't leave us having copied for nothing.
 	i, ok := inode.findChild(name)
 	if !ok {
 		panic(fmt.Sprintf("Unknown child: %s", name))
 	}
 
+	inode.cowEntries()
+
+	// Update the modification time.
+	inode.attributes.Mtime = inode.clock.Now()
+
 	// Mark it as unused.
-	inode.entries[i] = fuseutil.Dirent{
+	inode.entries.entries[i] = fuseutil.Dirent{
 		Type:   fuseutil.DT_Unknown,
 		Offset: fuse.DirOffset(i + 1),
 	}
@@ -282,22 +485,22 @@ func (inode *inode) RemoveChild(name string) {
 
 // Serve a ReadDir request.
 //
-// REQUIRES: inode.dir
+// REQUIRES: inode.kind == inodeTypeDir
 // SHARED_LOCKS_REQUIRED(inode.mu)
 func (inode *inode) ReadDir(offset int, size int) (data []byte, err error) {
-	if !inode.dir {
+	if inode.kind != inodeTypeDir {
 		panic("ReadDir called on non-directory.")
 	}
 
-	for i := offset; i < len(inode.entries); i++ {
-		e := inode.entries[i]
+	for i := offset; i < len(inode.entries.entries); i++ {
+		e := inode.entries.entries[i]
 
 		// Skip unused entries.
 		if e.Type == fuseutil.DT_Unknown {
 			continue
 		}
 
-		data = fuseutil.AppendDirent(data, inode.entries[i])
+		data = fuseutil.AppendDirent(data, inode.entries.entries[i])
 
 		// Trim and stop early if we've exceeded the requested size.
 		if len(data) > size {
@@ -311,21 +514,28 @@ func (inode *inode) ReadDir(offset int, size int) (data []byte, err error) {
 
 // Read from the file's contents. See documentation for ioutil.ReaderAt.
 //
-// REQUIRES: !inode.dir
+// REQUIRES: inode.kind == inodeTypeFile
 // SHARED_LOCKS_REQUIRED(inode.mu)
 func (inode *inode) ReadAt(p []byte, off int64) (n int, err error) {
-	if inode.dir {
-		panic("ReadAt called on directory.")
+	if inode.kind != inodeTypeFile {
+		panic("ReadAt called on non-file.")
 	}
 
 	// Ensure the offset is in range.
-	if off > int64(len(inode.contents)) {
+	size := int64(inode.attributes.Size)
+	if off > size {
 		err = io.EOF
 		return
 	}
 
-	// Read what we can.
-	n = copy(p, inode.contents[off:])
+	// Don't read past the logical end of the file. Before it, anything
+	// within an unwritten hole reads back as zeroes.
+	end := off + int64(len(p))
+	if end > size {
+		end = size
+	}
+
+	n = inode.contents.ReadAt(p[:end-off], off)
 	if n < len(p) {
 		err = io.EOF
 	}
@@ -335,26 +545,26 @@ func (inode *inode) ReadAt(p []byte, off int64) (n int, err error) {
 
 // Write to the file's contents. See documentation for ioutil.WriterAt.
 //
-// REQUIRES: !inode.dir
+// REQUIRES: inode.kind == inodeTypeFile
 // EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
 func (inode *inode) WriteAt(p []byte, off int64) (n int, err error) {
-	if inode.dir {
-		panic("WriteAt called on directory.")
+	if inode.kind != inodeTypeFile {
+		panic("WriteAt called on non-file.")
 	}
 
 	// Update the modification time.
 	inode.attributes.Mtime = inode.clock.Now()
 
-	// Ensure that the contents slice is long enough.
-	newLen := int(off) + len(p)
-	if len(inode.contents) < newLen {
-		padding := make([]byte, newLen-len(inode.contents))
-		inode.contents = append(inode.contents, padding...)
-		inode.attributes.Size = uint64(newLen)
+	// Grow the logical size if necessary. Note that this does not allocate
+	// storage for whole pages in the gap between the old size and off; those
+	// remain a hole. Only the pages that p touches are allocated.
+	newLen := uint64(off) + uint64(len(p))
+	if inode.attributes.Size < newLen {
+		inode.attributes.Size = newLen
 	}
 
 	// Copy in the data.
-	n = copy(inode.contents[off:], p)
+	n = inode.contents.WriteAt(p, off)
 
 	// Sanity check.
 	if n != len(p) {
@@ -364,6 +574,144 @@ func (inode *inode) WriteAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
+// Return the offset of the next data region or hole at or after off,
+// matching the semantics of SEEK_DATA/SEEK_HOLE in lseek(2). whence must be
+// seekData or seekHole. EOF counts as an implicit hole; seeking for data at
+// or past EOF returns syscall.ENXIO.
+//
+// REQUIRES: inode.kind == inodeTypeFile
+// SHARED_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) Lseek(off int64, whence int) (int64, error) {
+	if inode.kind != inodeTypeFile {
+		panic("Lseek called on non-file.")
+	}
+
+	return inode.contents.Lseek(off, whence, int64(inode.attributes.Size))
+}
+
+// Read the target of a symlink.
+//
+// REQUIRES: inode.kind == inodeTypeSymlink
+// SHARED_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) Readlink() (target string) {
+	if inode.kind != inodeTypeSymlink {
+		panic("Readlink called on non-symlink.")
+	}
+
+	return inode.target
+}
+
+// Record that a new hardlink has been created pointing at this inode. The
+// caller is responsible for adding the corresponding directory entry with
+// AddChild.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) IncrementLinkCount() {
+	inode.linkCount++
+}
+
+// Record that a hardlink pointing at this inode has been removed. The
+// caller is responsible for removing the corresponding directory entry with
+// RemoveChild.
+//
+// REQUIRES: inode.linkCount > 0
+// EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) DecrementLinkCount() {
+	if inode.linkCount <= 0 {
+		panic(fmt.Sprintf("Unexpected link count: %v", inode.linkCount))
+	}
+
+	inode.linkCount--
+}
+
+// An immutable, point-in-time view of an inode's state, as returned by
+// Snapshot. The caller must eventually pass it to exactly one of
+// ReleaseSnapshot, to drop it, or Rollback, to restore it as the inode's
+// live state.
+type inodeSnapshot struct {
+	kind       inodeType
+	attributes fuse.InodeAttributes
+	target     string
+	linkCount  int
+	contents   *sparseFile
+	entries    *entryTable
+	xattrs     map[string][]byte
+}
+
+// Capture the inode's current state. Subsequent mutations of the inode's
+// contents or entries copy-on-write rather than disturbing the returned
+// snapshot.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) Snapshot() *inodeSnapshot {
+	snap := &inodeSnapshot{
+		kind:       inode.kind,
+		attributes: inode.attributes,
+		target:     inode.target,
+		linkCount:  inode.linkCount,
+	}
+
+	if inode.kind == inodeTypeFile {
+		snap.contents = inode.contents.snapshot()
+	}
+
+	if inode.kind == inodeTypeDir {
+		inode.entries.refCount++
+		snap.entries = inode.entries
+	}
+
+	if inode.xattrs != nil {
+		snap.xattrs = make(map[string][]byte, len(inode.xattrs))
+		for name, value := range inode.xattrs {
+			snap.xattrs[name] = value
+		}
+	}
+
+	return snap
+}
+
+// Atomically replace the inode's state with a previously-captured snapshot.
+// This consumes snap: its pages and entry table become the inode's live
+// state, so the caller must not pass it to ReleaseSnapshot afterwards.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) Rollback(snap *inodeSnapshot) {
+	// Drop the outgoing live state's hold on its pages; it's about to be
+	// replaced wholesale rather than mutated, so cowEntries/WriteAt won't do
+	// this for us.
+	if inode.contents != nil {
+		inode.contents.release()
+	}
+
+	inode.kind = snap.kind
+	inode.attributes = snap.attributes
+	inode.target = snap.target
+	inode.linkCount = snap.linkCount
+	inode.contents = snap.contents
+	inode.entries = snap.entries
+	inode.xattrs = snap.xattrs
+
+	// snap.entries's refCount was incremented by Snapshot to account for
+	// snap's hold on it. That hold is being consumed here rather than
+	// released as a standalone snapshot, so undo the increment now that the
+	// table is becoming the live state instead.
+	if inode.entries != nil {
+		inode.entries.refCount--
+	}
+}
+
+// Release a snapshot previously returned by Snapshot, dropping its
+// references to any pages or entry table it still holds.
+func (inode *inode) ReleaseSnapshot(snap *inodeSnapshot) {
+	if snap.contents != nil {
+		snap.contents.release()
+	}
+
+	if snap.entries != nil {
+		snap.entries.refCount--
+	}
+}
+
 // Update attributes from non-nil parameters.
 //
 // EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
@@ -374,19 +722,11 @@ func (inode *inode) SetAttributes(
 	// Update the modification time.
 	inode.attributes.Mtime = inode.clock.Now()
 
-	// Truncate?
-	if size != nil {
-		intSize := int(*size)
-
-		// Update contents.
-		if intSize <= len(inode.contents) {
-			inode.contents = inode.contents[:intSize]
-		} else {
-			padding := make([]byte, intSize-len(inode.contents))
-			inode.contents = append(inode.contents, padding...)
-		}
-
-		// Update attributes.
+	// Truncate? Only meaningful for regular files. Truncating up leaves a
+	// hole rather than allocating zeroed pages; truncating down frees any
+	// pages that fall entirely beyond the new size.
+	if size != nil && inode.kind == inodeTypeFile {
+		inode.contents.Truncate(int64(*size))
 		inode.attributes.Size = *size
 	}
 
@@ -399,4 +739,313 @@ func (inode *inode) SetAttributes(
 	if mtime != nil {
 		inode.attributes.Mtime = *mtime
 	}
-}
\ No newline at end of file
+}
+
+// Return the value of the named extended attribute, or syscall.ENODATA if it
+// is not set.
+//
+// SHARED_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) GetXattr(name string) (value []byte, err error) {
+	value, ok := inode.xattrs[name]
+	if !ok {
+		err = syscall.ENODATA
+	}
+
+	return
+}
+
+// Return the names of all extended attributes set on the inode.
+//
+// SHARED_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) ListXattr() (names []string) {
+	for name := range inode.xattrs {
+		names = append(names, name)
+	}
+
+	return
+}
+
+// Set the value of the named extended attribute, honoring the
+// XATTR_CREATE/XATTR_REPLACE semantics of flags. Returns syscall.EEXIST if
+// xattrCreate is set and the attribute already exists, or syscall.ENODATA if
+// xattrReplace is set and it does not.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) SetXattr(name string, value []byte, flags uint32) (err error) {
+	if name == "" || len(name) > xattrNameMax {
+		err = syscall.EINVAL
+		return
+	}
+
+	_, exists := inode.xattrs[name]
+	switch {
+	case flags&xattrCreate != 0 && exists:
+		err = syscall.EEXIST
+		return
+
+	case flags&xattrReplace != 0 && !exists:
+		err = syscall.ENODATA
+		return
+	}
+
+	if len(value) > xattrValueSizeMax {
+		err = syscall.E2BIG
+		return
+	}
+
+	totalSize := len(value)
+	for n, v := range inode.xattrs {
+		if n != name {
+			totalSize += len(v)
+		}
+	}
+
+	if totalSize > xattrTotalSizeMax {
+		err = syscall.E2BIG
+		return
+	}
+
+	if inode.xattrs == nil {
+		inode.xattrs = make(map[string][]byte)
+	}
+
+	inode.xattrs[name] = append([]byte{}, value...)
+	inode.attributes.Ctime = inode.clock.Now()
+
+	return
+}
+
+// Remove the named extended attribute. Returns syscall.ENODATA if it is not
+// set.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(inode.mu)
+func (inode *inode) RemoveXattr(name string) (err error) {
+	if _, ok := inode.xattrs[name]; !ok {
+		err = syscall.ENODATA
+		return
+	}
+
+	delete(inode.xattrs, name)
+	inode.attributes.Ctime = inode.clock.Now()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Sparse file storage
+////////////////////////////////////////////////////////////////////////
+
+// The granularity at which sparseFile tracks which regions of a file are
+// backed by storage. A page is either entirely present, in which case it
+// holds pageSize bytes (some of which may be zero), or entirely absent, in
+// which case it is a hole and reads as all zeroes.
+const pageSize = 4096
+
+// A single page of a sparseFile's contents, reference-counted so that a
+// snapshot can hold onto a page while the live file writes through a fresh
+// copy of it.
+type sparsePage struct {
+	data []byte
+
+	// The number of sparseFiles (the live file plus zero or more snapshots)
+	// that hold a reference to this page.
+	refCount int
+}
+
+// A sparse representation of a file's contents: a set of fixed-size pages
+// keyed by page index, with gaps between them treated as holes rather than
+// runs of zero bytes. This allows WriteAt past EOF and SetAttributes
+// truncate-up to avoid allocating memory for the gap they create.
+//
+// Pages are shared copy-on-write with any outstanding snapshot taken by
+// Snapshot: mutating a page that a snapshot also references clones it
+// first, so the snapshot's view is unaffected.
+//
+// sparseFile knows nothing of the file's logical size; that is tracked by
+// the owning inode's attributes.Size, and is expected to be passed in to
+// or derived from the set of pages as needed.
+type sparseFile struct {
+	pages map[int64]*sparsePage
+}
+
+func newSparseFile() *sparseFile {
+	return &sparseFile{pages: make(map[int64]*sparsePage)}
+}
+
+// Return a copy-on-write snapshot of f's current contents: an independent
+// page table that shares pages with f until one of the two writes through
+// one of them. The caller must eventually call release on the result.
+func (f *sparseFile) snapshot() *sparseFile {
+	clone := &sparseFile{pages: make(map[int64]*sparsePage, len(f.pages))}
+	for idx, page := range f.pages {
+		page.refCount++
+		clone.pages[idx] = page
+	}
+
+	return clone
+}
+
+// Release a snapshot previously returned by snapshot, dropping its
+// references to any pages it still holds. Once no sparseFile references a
+// page, it becomes eligible for garbage collection.
+func (f *sparseFile) release() {
+	for _, page := range f.pages {
+		page.refCount--
+	}
+}
+
+// Return the start offset of the highest-indexed page with any storage
+// behind it, or -1 if the file has no pages at all. This is used only for
+// the inode's invariant check; it is not the file's logical size, which may
+// be larger due to a hole at the end, nor is it the true high-water byte,
+// which may fall anywhere within the returned page.
+func (f *sparseFile) maxOffset() int64 {
+	max := int64(-1)
+	for idx := range f.pages {
+		if start := idx * pageSize; start > max {
+			max = start
+		}
+	}
+
+	return max
+}
+
+// Read into p the bytes of the file starting at off. Unlike ReaderAt, this
+// never returns an error; it is the caller's responsibility to bound len(p)
+// by the file's logical size and turn a short read into io.EOF.
+func (f *sparseFile) ReadAt(p []byte, off int64) (n int) {
+	for n < len(p) {
+		cur := off + int64(n)
+		pageIndex := cur / pageSize
+		pageOffset := cur % pageSize
+
+		chunk := int64(len(p)-n)
+		if avail := pageSize - pageOffset; chunk > avail {
+			chunk = avail
+		}
+
+		if page, ok := f.pages[pageIndex]; ok {
+			copy(p[n:int64(n)+chunk], page.data[pageOffset:pageOffset+chunk])
+		} else {
+			// A hole reads back as zeroes. p is not guaranteed to already be
+			// zeroed (e.g. fuse read buffers aren't), so zero it explicitly.
+			hole := p[n : int64(n)+chunk]
+			for i := range hole {
+				hole[i] = 0
+			}
+		}
+
+		n += int(chunk)
+	}
+
+	return
+}
+
+// Write the bytes of p into the file starting at off, allocating whatever
+// pages are necessary and zero-filling the portions of newly-allocated
+// pages that p does not cover. If a page being written through is shared
+// with a snapshot, it is cloned first so the snapshot's view is unaffected.
+func (f *sparseFile) WriteAt(p []byte, off int64) (n int) {
+	for n < len(p) {
+		cur := off + int64(n)
+		pageIndex := cur / pageSize
+		pageOffset := cur % pageSize
+
+		chunk := int64(len(p)-n)
+		if avail := pageSize - pageOffset; chunk > avail {
+			chunk = avail
+		}
+
+		page, ok := f.pages[pageIndex]
+		switch {
+		case !ok:
+			page = &sparsePage{data: make([]byte, pageSize), refCount: 1}
+			f.pages[pageIndex] = page
+
+		case page.refCount > 1:
+			page.refCount--
+			page = &sparsePage{data: append([]byte(nil), page.data...), refCount: 1}
+			f.pages[pageIndex] = page
+		}
+
+		copy(page.data[pageOffset:pageOffset+chunk], p[n:int64(n)+chunk])
+		n += int(chunk)
+	}
+
+	return
+}
+
+// Discard any page that starts at or beyond size, in response to a
+// truncate. If size falls in the middle of a page, that page's tail is
+// zeroed rather than dropped, so that extending the file back past size
+// later doesn't resurrect the discarded bytes. The caller is responsible
+// for updating the logical size.
+func (f *sparseFile) Truncate(size int64) {
+	for idx, page := range f.pages {
+		if idx*pageSize >= size {
+			page.refCount--
+			delete(f.pages, idx)
+		}
+	}
+
+	if pageOffset := size % pageSize; pageOffset != 0 {
+		idx := size / pageSize
+		if page, ok := f.pages[idx]; ok {
+			if page.refCount > 1 {
+				page.refCount--
+				page = &sparsePage{data: append([]byte(nil), page.data...), refCount: 1}
+				f.pages[idx] = page
+			}
+
+			tail := page.data[pageOffset:]
+			for i := range tail {
+				tail[i] = 0
+			}
+		}
+	}
+}
+
+// Implement SEEK_DATA/SEEK_HOLE as specified by lseek(2): starting from off,
+// return the offset of the next byte backed by storage (seekData) or the
+// next byte that is either a hole or past size (seekHole). EOF counts as an
+// implicit hole. Pages are the unit of "data" here, so a page holding any
+// written bytes counts as data in its entirety.
+func (f *sparseFile) Lseek(off int64, whence int, size int64) (int64, error) {
+	switch whence {
+	case seekData:
+		if off >= size {
+			return 0, syscall.ENXIO
+		}
+
+		for pos := off; pos < size; {
+			idx := pos / pageSize
+			if _, ok := f.pages[idx]; ok {
+				return pos, nil
+			}
+
+			pos = (idx + 1) * pageSize
+		}
+
+		return 0, syscall.ENXIO
+
+	case seekHole:
+		if off > size {
+			return 0, syscall.ENXIO
+		}
+
+		for pos := off; pos < size; {
+			idx := pos / pageSize
+			if _, ok := f.pages[idx]; !ok {
+				return pos, nil
+			}
+
+			pos = (idx + 1) * pageSize
+		}
+
+		// The end of the file is always an implicit hole.
+		return size, nil
+
+	default:
+		return 0, syscall.EINVAL
+	}
+}